@@ -17,14 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"os/exec"
-	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -32,6 +31,7 @@ import (
 	"k8s.io/test-infra/prow/config"
 	"k8s.io/test-infra/prow/kube"
 	"k8s.io/test-infra/prow/plank"
+	"k8s.io/test-infra/prow/reporter"
 )
 
 var (
@@ -42,6 +42,20 @@ var (
 	logJSON        = flag.Bool("log-json", false, "output log in JSON format")
 	configPath     = flag.String("config-path", "/etc/config/config", "Where is config.yaml.")
 	maxBatchSize   = flag.Int("batch-size", 5, "Maximum batch size")
+	rerereCacheDir = flag.String("rerere-cache-dir", "", "Directory to persist the git rerere resolution cache in across restarts. Disabled if empty.")
+	cacheDir       = flag.String("cache-dir", "", "Directory to persist the splicer's git repo in across restarts, fetched incrementally instead of re-cloned. A fresh temp dir is used if empty.")
+	maxRefAge      = flag.Duration("max-ref-age", 7*24*time.Hour, "Prune a PR's pr/N ref in --cache-dir once its head commit's committer date is older than this.")
+
+	queueSourceKind   = flag.String("queue-source", "submitqueue", "Where to read the queue of candidate PRs from: submitqueue, github, or gerrit.")
+	githubQueueLabels = flag.String("github-queue-labels", "lgtm,approved", "Comma-separated labels a PR must carry to be queued when --queue-source=github.")
+	githubTokenPath   = flag.String("github-token-path", "", "Path to a GitHub OAuth token, used when --queue-source=github and to enable batch result reporting.")
+	gerritHost        = flag.String("gerrit-host", "", "Gerrit instance URL, used when --queue-source=gerrit.")
+	gerritProject     = flag.String("gerrit-project", "", "Gerrit project name, used when --queue-source=gerrit.")
+	gerritBranch      = flag.String("gerrit-branch", "master", "Gerrit destination branch, used when --queue-source=gerrit.")
+
+	reportContext = flag.String("report-context", "prow/batch", "GitHub commit status context to report batch results under. Reporting is disabled if --github-token-path is unset.")
+
+	batchScorerKind = flag.String("batch-scorer", "count", "How to score candidate batches when picking among conflict-free subsets: count, or priority (requires --queue-source=github).")
 )
 
 // Call a binary and return its output and success status.
@@ -89,122 +103,6 @@ func getQueuedPRs(url string) ([]int, error) {
 	return ret, nil
 }
 
-// Splicer manages a git repo in specific directory.
-type splicer struct {
-	dir string // The repository location.
-}
-
-// makeSplicer returns a splicer in a new temporary directory,
-// with an initial .git dir created.
-func makeSplicer() (*splicer, error) {
-	dir, err := ioutil.TempDir("", "splice_")
-	if err != nil {
-		return nil, err
-	}
-	s := &splicer{dir}
-	err = s.gitCalls([][]string{
-		{"init"},
-		{"config", "--local", "user.name", "K8S Prow Splice"},
-		{"config", "--local", "user.email", "splice@localhost"},
-	})
-	if err != nil {
-		s.cleanup()
-		return nil, err
-	}
-	log.Debug("splicer created in", dir)
-	return s, nil
-}
-
-// cleanup recurisvely deletes the repository
-func (s *splicer) cleanup() {
-	os.RemoveAll(s.dir)
-}
-
-// gitCall is a helper to call `git -C $path $args`.
-func (s *splicer) gitCall(args ...string) error {
-	fullArgs := append([]string{"-C", s.dir}, args...)
-	output, err := call("git", fullArgs...)
-	if len(output) > 0 {
-		log.Debug(output)
-	}
-	return err
-}
-
-// gitCalls is a helper to chain repeated gitCall invocations,
-// returning the first failure, or nil if they all succeeded.
-func (s *splicer) gitCalls(argsList [][]string) error {
-	for _, args := range argsList {
-		err := s.gitCall(args...)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// findMergeable fetches given PRs from upstream, merges them locally,
-// and finally returns a list of PRs that can be merged without conflicts.
-func (s *splicer) findMergeable(remote string, prs []int) ([]int, error) {
-	args := []string{"fetch", "-f", remote, "master:master"}
-	for _, pr := range prs {
-		args = append(args, fmt.Sprintf("pull/%d/head:pr/%d", pr, pr))
-	}
-
-	err := s.gitCalls([][]string{
-		{"reset", "--hard"},
-		{"checkout", "--orphan", "blank"},
-		{"reset", "--hard"},
-		{"clean", "-fdx"},
-		args,
-		{"checkout", "-B", "batch", "master"},
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	out := []int{}
-	for _, pr := range prs {
-		err := s.gitCall("merge", "--no-ff", "--no-stat",
-			"-m", fmt.Sprintf("merge #%d", pr),
-			fmt.Sprintf("pr/%d", pr))
-		if err != nil {
-			// merge conflict: cleanup and move on
-			err = s.gitCall("merge", "--abort")
-			if err != nil {
-				return nil, err
-			}
-			continue
-		}
-		out = append(out, pr)
-	}
-	return out, nil
-}
-
-// gitRef returns the SHA for the given git object-- a branch, generally.
-func (s *splicer) gitRef(ref string) string {
-	output, err := call("git", "-C", s.dir, "rev-parse", ref)
-	if err != nil {
-		return ""
-	}
-	return strings.TrimSpace(output)
-}
-
-// Produce a kube.Refs for the given pull requests. This involves computing the
-// git ref for master and the PRs.
-func (s *splicer) makeBuildRefs(org, repo string, prs []int) kube.Refs {
-	refs := kube.Refs{
-		Org:     org,
-		Repo:    repo,
-		BaseRef: "master",
-		BaseSHA: s.gitRef("master"),
-	}
-	for _, pr := range prs {
-		branch := fmt.Sprintf("pr/%d", pr)
-		refs.Pulls = append(refs.Pulls, kube.Pull{Number: pr, SHA: s.gitRef(branch)})
-	}
-	return refs
-}
-
 // Filters to the list of jobs which already passed this commit
 func completedJobs(currentJobs []kube.ProwJob, refs kube.Refs) []kube.ProwJob {
 	var skippable []kube.ProwJob
@@ -243,6 +141,21 @@ func requiredPresubmits(presubmits []config.Presubmit) []config.Presubmit {
 	return out
 }
 
+// batchScorer picks the BatchScorer selected by --batch-scorer, falling
+// back to CountScorer if priority scoring was requested but the active
+// queue source doesn't expose PR priorities.
+func batchScorer(queueSource QueueSource) BatchScorer {
+	if *batchScorerKind != "priority" {
+		return CountScorer{}
+	}
+	pp, ok := queueSource.(PriorityProvider)
+	if !ok {
+		log.Warning("--batch-scorer=priority requires a queue source that implements PriorityProvider; falling back to count.")
+		return CountScorer{}
+	}
+	return PriorityScorer{Priority: pp.Priorities()}
+}
+
 // Filters to the list of required presubmit which have not already passed this commit
 func neededPresubmits(presubmits []config.Presubmit, currentJobs []kube.ProwJob, refs kube.Refs) []config.Presubmit {
 	skippable := make(map[string]bool)
@@ -268,12 +181,17 @@ func main() {
 	}
 	log.SetLevel(log.DebugLevel)
 
-	splicer, err := makeSplicer()
+	splicer, err := makeSplicer(*cacheDir, *remoteURL, *rerereCacheDir)
 	if err != nil {
 		log.WithError(err).Fatal("Could not make splicer.")
 	}
 	defer splicer.cleanup()
 
+	queueSource, err := newQueueSource(*queueSourceKind)
+	if err != nil {
+		log.WithError(err).Fatal("Could not set up queue source.")
+	}
+
 	ca := &config.Agent{}
 	if err := ca.Start(*configPath); err != nil {
 		log.WithError(err).Fatal("Could not start config agent.")
@@ -284,9 +202,25 @@ func main() {
 		log.WithError(err).Fatal("Error getting kube client.")
 	}
 
+	var rep *reporter.Reporter
+	if *githubTokenPath != "" {
+		rep, err = reporter.New(*githubTokenPath, *reportContext)
+		if err != nil {
+			log.WithError(err).Fatal("Could not set up reporter.")
+		}
+	}
+
 	cooldown := 0
+	ticks := 0
 	// Loop endlessly, sleeping a minute between iterations
 	for range time.Tick(1 * time.Minute) {
+		ticks++
+		if *cacheDir != "" && ticks%60 == 0 {
+			if err := splicer.Prune(*maxRefAge); err != nil {
+				log.WithError(err).Warning("Error pruning stale pr/N refs.")
+			}
+		}
+
 		// List batch jobs, only start a new one if none are active.
 		currentJobs, err := kc.ListProwJobs(nil)
 		if err != nil {
@@ -315,9 +249,9 @@ func main() {
 			continue
 		}
 
-		queue, err := getQueuedPRs(*submitQueueURL)
+		queue, err := queueSource.QueuedPRs()
 		if err != nil {
-			log.WithError(err).Warning("Error getting queued PRs. Is the submit queue down?")
+			log.WithError(err).Warning("Error getting queued PRs.")
 			continue
 		}
 		// No need to check for mergeable PRs if none is in the queue.
@@ -325,27 +259,86 @@ func main() {
 			continue
 		}
 		log.Infof("PRs in queue: %v", queue)
-		batchPRs, err := splicer.findMergeable(*remoteURL, queue)
+		batchPRs, conflicts, err := splicer.findMergeable(*remoteURL, queue, *maxBatchSize, batchScorer(queueSource))
 		if err != nil {
 			log.WithError(err).Error("Error computing mergeable PRs.")
 			continue
 		}
+		for _, c := range conflicts {
+			if c.ConflictsWith == 0 {
+				log.Infof("PR #%d conflicts with master or the batch (files: %v)", c.PR, c.Files)
+			} else {
+				log.Infof("PR #%d conflicts with PR #%d (files: %v)", c.PR, c.ConflictsWith, c.Files)
+			}
+		}
 		// No need to start batches for single PRs
 		if len(batchPRs) <= 1 {
 			continue
 		}
-		// Trim down to the desired batch size.
-		if len(batchPRs) > *maxBatchSize {
-			batchPRs = batchPRs[:*maxBatchSize]
-		}
 		log.Infof("Starting a batch for the following PRs: %v", batchPRs)
 		refs := splicer.makeBuildRefs(*orgName, *repoName, batchPRs)
 		presubmits := ca.Config().Presubmits[fmt.Sprintf("%s/%s", *orgName, *repoName)]
+		started := 0
 		for _, job := range neededPresubmits(presubmits, currentJobs, refs) {
 			if _, err := kc.CreateProwJob(plank.NewProwJob(plank.BatchSpec(job, refs))); err != nil {
 				log.WithError(err).WithField("job", job.Name).Error("Error starting batch job.")
+				continue
 			}
+			started++
+		}
+		// If nothing actually ran (e.g. every presubmit was already
+		// skippable, or every CreateProwJob call failed), there is nothing
+		// to watch for and reporting "success" would be a lie.
+		if rep != nil && started > 0 {
+			go watchAndReport(kc, rep, *orgName, *repoName, refs, conflicts)
 		}
 		cooldown = 5
 	}
 }
+
+// watchAndReport polls until every BatchJob ProwJob for refs has completed,
+// then reports the combined result back to the participating PRs.
+func watchAndReport(kc *kube.Client, rep *reporter.Reporter, org, repo string, refs kube.Refs, conflicts []ConflictReport) {
+	rs := refs.String()
+	var batchJobs []kube.ProwJob
+	for range time.Tick(30 * time.Second) {
+		currentJobs, err := kc.ListProwJobs(nil)
+		if err != nil {
+			log.WithError(err).Error("Error listing prow jobs while watching batch.")
+			continue
+		}
+
+		batchJobs = batchJobs[:0]
+		done := true
+		for _, job := range currentJobs {
+			if job.Spec.Type != kube.BatchJob || job.Spec.Refs.String() != rs {
+				continue
+			}
+			batchJobs = append(batchJobs, job)
+			if !job.Complete() {
+				done = false
+			}
+		}
+		// Nothing matched refs yet (or anymore) -- keep waiting rather
+		// than reporting a false "success" for a batch that never ran.
+		if !done || len(batchJobs) == 0 {
+			continue
+		}
+
+		var repConflicts []reporter.Conflict
+		for _, c := range conflicts {
+			repConflicts = append(repConflicts, reporter.Conflict{PR: c.PR, ConflictsWith: c.ConflictsWith, Files: c.Files})
+		}
+		err = rep.Report(context.Background(), reporter.BatchResult{
+			Org:       org,
+			Repo:      repo,
+			Refs:      refs,
+			Jobs:      batchJobs,
+			Conflicts: repConflicts,
+		})
+		if err != nil {
+			log.WithError(err).Error("Error reporting batch result.")
+		}
+		return
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "sort"
+
+// BatchScorer scores a candidate batch of PRs, so the optimizer can select
+// among several conflict-free subsets of equal or differing size.
+type BatchScorer interface {
+	Score(prs []int) int
+}
+
+// CountScorer scores a batch by how many PRs it contains. This is the
+// default, and matches the behavior of always preferring a bigger batch.
+type CountScorer struct{}
+
+// Score implements BatchScorer.
+func (CountScorer) Score(prs []int) int {
+	return len(prs)
+}
+
+// PriorityScorer scores a batch by the sum of each PR's priority, e.g. as
+// derived from a priority/Px label. PRs with no recorded priority score 0.
+type PriorityScorer struct {
+	Priority map[int]int
+}
+
+// Score implements BatchScorer.
+func (p PriorityScorer) Score(prs []int) int {
+	total := 0
+	for _, pr := range prs {
+		total += p.Priority[pr]
+	}
+	return total
+}
+
+// optimizeBatch selects the subset of candidates, of size at most
+// maxBatchSize, with no two members in conflict, that maximizes
+// scorer.Score. It assumes scorer is additive over individual PRs (true for
+// both CountScorer and PriorityScorer), which lets it compute a cheap upper
+// bound for branch-and-bound pruning from each PR's solo score.
+func optimizeBatch(scorer BatchScorer, candidates []int, conflicts func(a, b int) bool, maxBatchSize int) []int {
+	weight := make(map[int]int, len(candidates))
+	for _, pr := range candidates {
+		weight[pr] = scorer.Score([]int{pr})
+	}
+
+	ordered := append([]int{}, candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return weight[ordered[i]] > weight[ordered[j]]
+	})
+
+	var bestSet []int
+	bestScore := -1
+
+	var search func(i int, chosen []int, score int)
+	search = func(i int, chosen []int, score int) {
+		if score > bestScore {
+			bestScore = score
+			bestSet = append([]int{}, chosen...)
+		}
+		if i == len(ordered) || len(chosen) == maxBatchSize {
+			return
+		}
+
+		// Upper bound: ordered is sorted by descending weight, so the best
+		// achievable score from here on is simply the top remaining
+		// weights filling the remaining slots -- an overestimate, since it
+		// ignores conflicts, but cheap and valid for pruning.
+		bound := score
+		slots := maxBatchSize - len(chosen)
+		for j := i; j < len(ordered) && slots > 0; j++ {
+			bound += weight[ordered[j]]
+			slots--
+		}
+		if bound <= bestScore {
+			return
+		}
+
+		pr := ordered[i]
+		compatible := true
+		for _, c := range chosen {
+			if conflicts(pr, c) {
+				compatible = false
+				break
+			}
+		}
+		if compatible {
+			search(i+1, append(chosen, pr), score+weight[pr])
+		}
+		search(i+1, chosen, score)
+	}
+	search(0, nil, 0)
+
+	return bestSet
+}
+
+// pairProbeCache remembers the outcome of pairwise merge probes so repeated
+// optimizer runs across ticks don't re-probe the same (base, pr1, pr2)
+// combination.
+type pairProbeCache struct {
+	s     *splicer
+	cache map[string]bool
+}
+
+func newPairProbeCache(s *splicer) *pairProbeCache {
+	return &pairProbeCache{s: s, cache: map[string]bool{}}
+}
+
+func (c *pairProbeCache) key(base, shaA, shaB string) string {
+	if shaA > shaB {
+		shaA, shaB = shaB, shaA
+	}
+	return base + "|" + shaA + "|" + shaB
+}
+
+// conflicts reports whether pr a and pr b conflict when merged together
+// onto master, consulting (and populating) the cache keyed by the base and
+// PR SHAs involved.
+func (c *pairProbeCache) conflicts(base string, a, b int) (bool, error) {
+	shaA, shaB := c.s.gitRef(prBranch(a)), c.s.gitRef(prBranch(b))
+	key := c.key(base, shaA, shaB)
+	if v, ok := c.cache[key]; ok {
+		return v, nil
+	}
+	_, conflicted, err := c.s.tryPairMerge(b, a)
+	if err != nil {
+		return false, err
+	}
+	c.cache[key] = conflicted
+	return conflicted, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountScorer(t *testing.T) {
+	var s CountScorer
+	if got, want := s.Score([]int{1, 2, 3}), 3; got != want {
+		t.Errorf("Score() = %d, want %d", got, want)
+	}
+	if got, want := s.Score(nil), 0; got != want {
+		t.Errorf("Score(nil) = %d, want %d", got, want)
+	}
+}
+
+func TestPriorityScorer(t *testing.T) {
+	s := PriorityScorer{Priority: map[int]int{1: 3, 2: 1}}
+	if got, want := s.Score([]int{1, 2}), 4; got != want {
+		t.Errorf("Score() = %d, want %d", got, want)
+	}
+	// PRs with no recorded priority score 0, not an error.
+	if got, want := s.Score([]int{1, 99}), 3; got != want {
+		t.Errorf("Score() with unknown PR = %d, want %d", got, want)
+	}
+}
+
+func TestOptimizeBatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		candidates   []int
+		conflicts    [][2]int
+		maxBatchSize int
+		want         []int
+	}{
+		{
+			name:         "no conflicts picks everyone up to the cap",
+			candidates:   []int{1, 2, 3},
+			maxBatchSize: 5,
+			want:         []int{1, 2, 3},
+		},
+		{
+			name:         "cap below candidate count picks the cap",
+			candidates:   []int{1, 2, 3, 4},
+			maxBatchSize: 2,
+			want:         []int{1, 2},
+		},
+		{
+			name:         "conflicting pair: keep the larger independent set",
+			candidates:   []int{1, 2, 3},
+			conflicts:    [][2]int{{1, 2}},
+			maxBatchSize: 5,
+			want:         []int{1, 3},
+		},
+		{
+			name:         "conflict graph forces picking just one",
+			candidates:   []int{1, 2, 3},
+			conflicts:    [][2]int{{1, 2}, {1, 3}, {2, 3}},
+			maxBatchSize: 5,
+			want:         []int{1},
+		},
+		{
+			name:         "prefers higher priority over a larger batch",
+			candidates:   []int{1, 2, 3},
+			conflicts:    [][2]int{{1, 3}, {2, 3}},
+			maxBatchSize: 5,
+			want:         []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflicts := map[[2]int]bool{}
+			for _, c := range tt.conflicts {
+				conflicts[c] = true
+			}
+			conflictFn := func(a, b int) bool {
+				if a > b {
+					a, b = b, a
+				}
+				return conflicts[[2]int{a, b}]
+			}
+			scorer := BatchScorer(CountScorer{})
+			if tt.name == "prefers higher priority over a larger batch" {
+				scorer = PriorityScorer{Priority: map[int]int{1: 1, 2: 1, 3: 5}}
+			}
+			got := optimizeBatch(scorer, tt.candidates, conflictFn, tt.maxBatchSize)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optimizeBatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptimizeBatchEmpty(t *testing.T) {
+	got := optimizeBatch(CountScorer{}, nil, func(a, b int) bool { return false }, 5)
+	if len(got) != 0 {
+		t.Errorf("optimizeBatch(nil) = %v, want empty", got)
+	}
+}
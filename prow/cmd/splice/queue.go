@@ -0,0 +1,220 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// QueueSource lists the PRs that are ready to be spliced into a batch.
+type QueueSource interface {
+	// QueuedPRs returns the numbers of the PRs currently eligible for
+	// batching against master.
+	QueuedPRs() ([]int, error)
+}
+
+// newQueueSource builds the QueueSource selected by --queue-source.
+func newQueueSource(kind string) (QueueSource, error) {
+	switch kind {
+	case "submitqueue":
+		return &submitQueueSource{url: *submitQueueURL}, nil
+	case "github":
+		return newGitHubQueueSource(*orgName, *repoName, *githubQueueLabels, *githubTokenPath)
+	case "gerrit":
+		return &gerritQueueSource{
+			host:    *gerritHost,
+			project: *gerritProject,
+			branch:  *gerritBranch,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown queue source %q", kind)
+	}
+}
+
+// submitQueueSource reads the list of queued PRs from the k8s Submit Queue.
+type submitQueueSource struct {
+	url string
+}
+
+func (s *submitQueueSource) QueuedPRs() ([]int, error) {
+	return getQueuedPRs(s.url)
+}
+
+// PriorityProvider is implemented by QueueSources that can additionally
+// rank the PRs they return, e.g. by a priority label, for use with
+// PriorityScorer.
+type PriorityProvider interface {
+	// Priorities returns the most recently observed priority for each
+	// queued PR, as seen by the last call to QueuedPRs.
+	Priorities() map[int]int
+}
+
+// githubQueueSource lists open PRs carrying all of a configurable set of
+// labels, for projects that never adopted mungegithub/submit-queue.
+type githubQueueSource struct {
+	client *github.Client
+	org    string
+	repo   string
+	labels []string
+
+	priorities map[int]int
+}
+
+func newGitHubQueueSource(org, repo, labels, tokenPath string) (*githubQueueSource, error) {
+	var hc *http.Client
+	if tokenPath != "" {
+		token, err := ioutil.ReadFile(tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading github token: %v", err)
+		}
+		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: strings.TrimSpace(string(token))})
+		hc = oauth2.NewClient(context.Background(), ts)
+	}
+	var labelList []string
+	for _, l := range strings.Split(labels, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labelList = append(labelList, l)
+		}
+	}
+	return &githubQueueSource{
+		client: github.NewClient(hc),
+		org:    org,
+		repo:   repo,
+		labels: labelList,
+	}, nil
+}
+
+func (s *githubQueueSource) QueuedPRs() ([]int, error) {
+	opt := &github.PullRequestListOptions{
+		State:       "open",
+		Base:        "master",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var ret []int
+	priorities := map[int]int{}
+	for {
+		prs, resp, err := s.client.PullRequests.List(context.Background(), s.org, s.repo, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if s.hasAllLabels(pr.Labels) {
+				ret = append(ret, pr.GetNumber())
+				priorities[pr.GetNumber()] = labelPriority(pr.Labels)
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	s.priorities = priorities
+	return ret, nil
+}
+
+// Priorities implements PriorityProvider.
+func (s *githubQueueSource) Priorities() map[int]int {
+	return s.priorities
+}
+
+func (s *githubQueueSource) hasAllLabels(have []*github.Label) bool {
+	names := make(map[string]bool, len(have))
+	for _, l := range have {
+		names[l.GetName()] = true
+	}
+	for _, want := range s.labels {
+		if !names[want] {
+			return false
+		}
+	}
+	return true
+}
+
+// labelPriority derives an integer priority from a "priority/Px" label
+// (lower x scores higher), defaulting to 0 when no such label is present.
+func labelPriority(labels []*github.Label) int {
+	best := 0
+	for _, l := range labels {
+		name := l.GetName()
+		if !strings.HasPrefix(name, "priority/P") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "priority/P"))
+		if err != nil {
+			continue
+		}
+		if weight := 4 - n; weight > best {
+			best = weight
+		}
+	}
+	return best
+}
+
+// gerritQueueSource polls a Gerrit instance's changes API for submittable
+// changes on a given project/branch, analogous to the gitmirror pattern used
+// elsewhere in prow for Gerrit-hosted repos.
+type gerritQueueSource struct {
+	host    string
+	project string
+	branch  string
+}
+
+// gerritChange is the subset of Gerrit's ChangeInfo we care about.
+type gerritChange struct {
+	Number      int  `json:"_number"`
+	Submittable bool `json:"submittable"`
+}
+
+func (s *gerritQueueSource) QueuedPRs() ([]int, error) {
+	q := fmt.Sprintf("status:open+project:%s+branch:%s+is:submittable", s.project, s.branch)
+	url := fmt.Sprintf("%s/changes/?q=%s&o=SUBMITTABLE", strings.TrimSuffix(s.host, "/"), q)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gerrit prefixes JSON responses with a magic XSSI-protection line.
+	body = []byte(strings.TrimPrefix(string(body), ")]}'\n"))
+
+	var changes []gerritChange
+	if err := json.Unmarshal(body, &changes); err != nil {
+		return nil, err
+	}
+
+	var ret []int
+	for _, c := range changes {
+		if c.Submittable {
+			ret = append(ret, c.Number)
+		}
+	}
+	return ret, nil
+}
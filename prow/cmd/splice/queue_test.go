@@ -0,0 +1,72 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func label(name string) *github.Label {
+	return &github.Label{Name: github.String(name)}
+}
+
+func TestHasAllLabels(t *testing.T) {
+	s := &githubQueueSource{labels: []string{"lgtm", "approved"}}
+
+	tests := []struct {
+		name string
+		have []*github.Label
+		want bool
+	}{
+		{"has both", []*github.Label{label("lgtm"), label("approved")}, true},
+		{"has extra labels too", []*github.Label{label("lgtm"), label("approved"), label("size/S")}, true},
+		{"missing one", []*github.Label{label("lgtm")}, false},
+		{"has neither", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.hasAllLabels(tt.have); got != tt.want {
+				t.Errorf("hasAllLabels(%v) = %v, want %v", tt.have, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelPriority(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []*github.Label
+		want   int
+	}{
+		{"no priority label", []*github.Label{label("lgtm")}, 0},
+		{"priority/P0", []*github.Label{label("priority/P0")}, 4},
+		{"priority/P3", []*github.Label{label("priority/P3")}, 1},
+		{"highest of several", []*github.Label{label("priority/P2"), label("priority/P0")}, 4},
+		{"malformed priority label ignored", []*github.Label{label("priority/Pfoo")}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := labelPriority(tt.labels); got != tt.want {
+				t.Errorf("labelPriority(%v) = %d, want %d", tt.labels, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,518 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/kube"
+)
+
+// ConflictReport attributes a PR that failed to merge into the batch to
+// the specific PR it conflicts with, if one could be identified.
+type ConflictReport struct {
+	PR int
+	// ConflictsWith is the PR number this PR conflicts with, or 0 if no
+	// single partner could be isolated: either the PR does not merge
+	// cleanly onto master on its own, or the conflict is attributed to the
+	// cumulative state of the batch.
+	ConflictsWith int
+	Files         []string
+}
+
+// Splicer manages a git repo in a specific directory. When cacheDir is set
+// on construction the directory (and its fetched objects and pr/N refs)
+// persist across restarts; individual merge/solo probes then run in
+// short-lived `git worktree` checkouts off of it, one at a time, so a probe
+// never has to re-fetch or re-clone the PRs and master it needs.
+//
+// Probing candidate batches concurrently (one goroutine per worktree) was
+// considered but deliberately cut from this pass: every worktree here still
+// shares one underlying .git (object store, index lock, rerere cache), and
+// making concurrent git invocations against it safe is a bigger change than
+// this series' scope. Probing stays sequential for now; revisit if probing
+// cost becomes the bottleneck it was meant to address.
+type splicer struct {
+	dir            string // The repository location.
+	rerereCacheDir string // Where to persist the rerere resolution cache, if set.
+	temporary      bool   // Whether dir is a throwaway TempDir that cleanup may delete.
+
+	probe *pairProbeCache // Pairwise merge-probe results, kept across findMergeable calls.
+}
+
+// makeSplicer returns a splicer backed by cacheDir, or by a fresh temporary
+// directory if cacheDir is empty. If cacheDir already holds a repo (e.g.
+// left over from before a restart) it is refreshed with a prune fetch;
+// otherwise it is hydrated with a partial clone of remote to keep the
+// working set small on large repos.
+func makeSplicer(cacheDir, remote, rerereCacheDir string) (*splicer, error) {
+	if cacheDir == "" {
+		dir, err := ioutil.TempDir("", "splice_")
+		if err != nil {
+			return nil, err
+		}
+		s := &splicer{dir: dir, rerereCacheDir: rerereCacheDir, temporary: true}
+		if err := s.gitCalls([][]string{
+			{"init"},
+			{"config", "--local", "user.name", "K8S Prow Splice"},
+			{"config", "--local", "user.email", "splice@localhost"},
+		}); err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		if err := s.enableRerere(); err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		if err := s.detachMainWorktree(); err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		log.Debug("splicer created in ", dir)
+		return s, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(cacheDir, ".git")); err == nil {
+		s := &splicer{dir: cacheDir, rerereCacheDir: rerereCacheDir}
+		if err := s.gitCall("fetch", "--prune", remote); err != nil {
+			return nil, fmt.Errorf("refreshing cache dir %s: %v", cacheDir, err)
+		}
+		if err := s.enableRerere(); err != nil {
+			return nil, err
+		}
+		if err := s.detachMainWorktree(); err != nil {
+			return nil, err
+		}
+		log.Debug("splicer reusing cache dir ", cacheDir)
+		return s, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cache dir: %v", err)
+	}
+	if _, err := call("git", "clone", "--filter=blob:none", "--no-checkout", remote, cacheDir); err != nil {
+		return nil, fmt.Errorf("hydrating cache dir %s: %v", cacheDir, err)
+	}
+	s := &splicer{dir: cacheDir, rerereCacheDir: rerereCacheDir}
+	if err := s.gitCalls([][]string{
+		{"config", "--local", "user.name", "K8S Prow Splice"},
+		{"config", "--local", "user.email", "splice@localhost"},
+	}); err != nil {
+		return nil, err
+	}
+	if err := s.enableRerere(); err != nil {
+		return nil, err
+	}
+	if err := s.detachMainWorktree(); err != nil {
+		return nil, err
+	}
+	log.Debug("splicer hydrated cache dir ", cacheDir)
+	return s, nil
+}
+
+// detachMainWorktree moves the splicer's own working tree off of any branch
+// name we might want to fetch into (master, pr/N, ...), since git refuses
+// to fetch updates into a branch that's checked out in a worktree. Batch
+// attempts never touch this working tree directly -- they run in scratch
+// `git worktree`s -- so leaving it permanently detached is harmless.
+func (s *splicer) detachMainWorktree() error {
+	if err := s.gitCall("checkout", "blank"); err != nil {
+		if err := s.gitCall("checkout", "--orphan", "blank"); err != nil {
+			return err
+		}
+	}
+	return s.gitCalls([][]string{
+		{"reset", "--hard"},
+		{"clean", "-fdx"},
+	})
+}
+
+// enableRerere turns on git rerere so that conflict resolutions are
+// remembered across batches, and points its cache at rerereCacheDir so the
+// cache survives process (and pod) restarts.
+func (s *splicer) enableRerere() error {
+	if err := s.gitCall("config", "--local", "rerere.enabled", "true"); err != nil {
+		return err
+	}
+	if s.rerereCacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.rerereCacheDir, 0755); err != nil {
+		return fmt.Errorf("creating rerere cache dir: %v", err)
+	}
+	rrCache := filepath.Join(s.dir, ".git", "rr-cache")
+	if _, err := os.Lstat(rrCache); err == nil {
+		if err := os.RemoveAll(rrCache); err != nil {
+			return fmt.Errorf("clearing local rr-cache: %v", err)
+		}
+	}
+	if err := os.Symlink(s.rerereCacheDir, rrCache); err != nil {
+		return fmt.Errorf("linking rr-cache to %s: %v", s.rerereCacheDir, err)
+	}
+	return nil
+}
+
+// cleanup recursively deletes the repository, but only if it's a temporary
+// one created for a run with no --cache-dir; persistent cache dirs are left
+// alone so they survive for the next run, even across an unrecovered panic.
+func (s *splicer) cleanup() {
+	if !s.temporary {
+		return
+	}
+	os.RemoveAll(s.dir)
+}
+
+// gitCall is a helper to call `git -C $path $args`.
+func (s *splicer) gitCall(args ...string) error {
+	_, err := s.gitCallOut(args...)
+	return err
+}
+
+// gitCallOut is a helper to call `git -C $path $args` and return its output.
+func (s *splicer) gitCallOut(args ...string) (string, error) {
+	return gitCallIn(s.dir, args...)
+}
+
+// gitCallIn runs `git -C $dir $args` and returns its combined output.
+func gitCallIn(dir string, args ...string) (string, error) {
+	fullArgs := append([]string{"-C", dir}, args...)
+	output, err := call("git", fullArgs...)
+	if len(output) > 0 {
+		log.Debug(output)
+	}
+	return output, err
+}
+
+// gitCalls is a helper to chain repeated gitCall invocations,
+// returning the first failure, or nil if they all succeeded.
+func (s *splicer) gitCalls(argsList [][]string) error {
+	for _, args := range argsList {
+		err := s.gitCall(args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newWorktree checks out ref into a fresh scratch `git worktree`, returning
+// its path and a cleanup func that removes both the worktree and its
+// backing directory. Each probe gets its own working tree off of the same
+// object store, so it can merge and inspect the result without disturbing
+// the splicer's own checkout -- callers still run probes one at a time,
+// since all worktrees share one underlying git repo/index lock.
+func (s *splicer) newWorktree(ref string) (string, func(), error) {
+	path, err := ioutil.TempDir("", "splice_wt_")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.gitCall("worktree", "add", "--detach", "-f", path, ref); err != nil {
+		os.RemoveAll(path)
+		return "", nil, err
+	}
+	cleanup := func() {
+		if err := s.gitCall("worktree", "remove", "--force", path); err != nil {
+			log.WithError(err).Warnf("Error removing worktree %s", path)
+		}
+		os.RemoveAll(path)
+	}
+	return path, cleanup, nil
+}
+
+// prBranch is the local ref a PR is fetched into.
+func prBranch(pr int) string {
+	return fmt.Sprintf("pr/%d", pr)
+}
+
+// findMergeable fetches the given PRs from upstream and selects the batch,
+// of at most maxBatchSize PRs, that maximizes scorer.Score among those with
+// no pairwise merge conflicts. PRs that can't make the cut because they
+// conflict with another PR are reported via the returned ConflictReport
+// slice, attributing the conflict to that specific PR where possible,
+// instead of being silently dropped.
+func (s *splicer) findMergeable(remote string, prs []int, maxBatchSize int, scorer BatchScorer) ([]int, []ConflictReport, error) {
+	args := []string{"fetch", "-f", remote, "master:master"}
+	for _, pr := range prs {
+		args = append(args, fmt.Sprintf("pull/%d/head:%s", pr, prBranch(pr)))
+	}
+	if err := s.gitCall(args...); err != nil {
+		return nil, nil, err
+	}
+	base := s.gitRef("master")
+
+	var soloOK []int
+	var conflicts []ConflictReport
+	for _, pr := range prs {
+		ok, files, err := s.trySolo(pr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			soloOK = append(soloOK, pr)
+			continue
+		}
+		conflicts = append(conflicts, ConflictReport{PR: pr, ConflictsWith: 0, Files: files})
+	}
+
+	if s.probe == nil {
+		s.probe = newPairProbeCache(s)
+	}
+	probe := s.probe
+	conflictFn := func(a, b int) bool {
+		conflicted, err := probe.conflicts(base, a, b)
+		if err != nil {
+			log.WithError(err).Warnf("Error probing PR #%d against #%d for conflicts", a, b)
+			return true // fail closed: don't batch PRs we couldn't verify
+		}
+		return conflicted
+	}
+
+	selected := optimizeBatch(scorer, soloOK, conflictFn, maxBatchSize)
+
+	// The pairwise probes above only prove no two PRs in `selected`
+	// conflict with each other; three-or-more-way interactions can still
+	// produce a conflict that no pair caught. Verify the actual selected
+	// batch by merging it cumulatively, and drop (and attribute) whatever
+	// doesn't survive that.
+	selected, verifyConflicts, err := s.verifyBatch(selected)
+	if err != nil {
+		return nil, nil, err
+	}
+	conflicts = append(conflicts, verifyConflicts...)
+
+	inBatch := make(map[int]bool, len(selected))
+	for _, pr := range selected {
+		inBatch[pr] = true
+	}
+	attributed := make(map[int]bool, len(verifyConflicts))
+	for _, c := range verifyConflicts {
+		attributed[c.PR] = true
+	}
+
+	partners := attributionPartners(soloOK, inBatch, attributed, conflictFn)
+	for _, pr := range soloOK {
+		partner, ok := partners[pr]
+		if !ok {
+			continue
+		}
+		files, _, err := s.tryPairMerge(pr, partner)
+		if err != nil {
+			return nil, nil, err
+		}
+		conflicts = append(conflicts, ConflictReport{PR: pr, ConflictsWith: partner, Files: files})
+	}
+
+	return selected, conflicts, nil
+}
+
+// attributionPartners decides, for each soloOK PR that didn't make the final
+// batch, which other PR (if any) to attribute its exclusion to. PRs already
+// in the batch or already attributed by verifyBatch are skipped, so a PR
+// verifyBatch dropped for an n-way conflict never also picks up a second,
+// contradictory attribution here. The return value maps an excluded PR to
+// its chosen partner; a PR excluded purely by the batch-size cap (no
+// conflicting partner found) has no entry.
+func attributionPartners(soloOK []int, inBatch, attributed map[int]bool, conflictFn func(a, b int) bool) map[int]int {
+	partners := make(map[int]int)
+	for _, pr := range soloOK {
+		if inBatch[pr] || attributed[pr] {
+			continue
+		}
+		// Prefer attributing to a partner that's actually in the final
+		// batch; fall back to any conflicting candidate so a PR excluded
+		// because it only conflicts with another excluded PR still gets
+		// reported, rather than being mistaken for cap-excluded.
+		partner := 0
+		for _, other := range soloOK {
+			if other == pr || !conflictFn(pr, other) {
+				continue
+			}
+			partner = other
+			if inBatch[other] {
+				break
+			}
+		}
+		if partner != 0 {
+			partners[pr] = partner
+		}
+	}
+	return partners
+}
+
+// verifyBatch merges the selected PRs together cumulatively in a single
+// worktree, to catch multi-way conflicts that the pairwise probes in
+// findMergeable can't see. Any PR that fails to merge on top of the ones
+// ahead of it is dropped and reported, attributed to the cumulative batch
+// state (ConflictsWith == 0), matching what the actual batch CI job would
+// encounter.
+func (s *splicer) verifyBatch(selected []int) ([]int, []ConflictReport, error) {
+	if len(selected) == 0 {
+		return selected, nil, nil
+	}
+
+	wt, cleanup, err := s.newWorktree("master")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	var out []int
+	var conflicts []ConflictReport
+	for _, pr := range selected {
+		_, err := gitCallIn(wt, "merge", "--no-ff", "--no-stat",
+			"-m", fmt.Sprintf("merge #%d", pr), prBranch(pr))
+		if err != nil {
+			diffOut, diffErr := gitCallIn(wt, "diff", "--name-only", "--diff-filter=U")
+			gitCallIn(wt, "merge", "--abort")
+			if diffErr != nil {
+				return nil, nil, diffErr
+			}
+			conflicts = append(conflicts, ConflictReport{PR: pr, ConflictsWith: 0, Files: splitLines(diffOut)})
+			continue
+		}
+		out = append(out, pr)
+	}
+	return out, conflicts, nil
+}
+
+// trySolo merges pr alone onto master in a scratch worktree, reporting
+// whether it applies cleanly and, if not, which files conflicted.
+func (s *splicer) trySolo(pr int) (bool, []string, error) {
+	wt, cleanup, err := s.newWorktree("master")
+	if err != nil {
+		return false, nil, err
+	}
+	defer cleanup()
+
+	_, err = gitCallIn(wt, "merge", "--no-ff", "--no-stat",
+		"-m", fmt.Sprintf("merge #%d", pr), prBranch(pr))
+	if err == nil {
+		return true, nil, nil
+	}
+
+	diffOut, diffErr := gitCallIn(wt, "diff", "--name-only", "--diff-filter=U")
+	gitCallIn(wt, "merge", "--abort")
+	if diffErr != nil {
+		return false, nil, diffErr
+	}
+	return false, splitLines(diffOut), nil
+}
+
+// tryPairMerge merges pr onto master+pr/m in a scratch worktree, reporting
+// whether it conflicted and, if so, which files were involved. Both pr and
+// m are assumed to already merge cleanly onto master on their own.
+func (s *splicer) tryPairMerge(pr, m int) ([]string, bool, error) {
+	wt, cleanup, err := s.newWorktree("master")
+	if err != nil {
+		return nil, false, err
+	}
+	defer cleanup()
+
+	if _, err := gitCallIn(wt, "merge", "--no-ff", "--no-stat",
+		"-m", fmt.Sprintf("merge #%d", m), prBranch(m)); err != nil {
+		// the solo merge of an already-accepted PR should not conflict;
+		// if it does, there's nothing useful to attribute here.
+		gitCallIn(wt, "merge", "--abort")
+		return nil, false, nil
+	}
+
+	_, err = gitCallIn(wt, "merge", "--no-ff", "--no-stat",
+		"-m", fmt.Sprintf("merge #%d", pr), prBranch(pr))
+	if err == nil {
+		return nil, false, nil
+	}
+
+	diffOut, diffErr := gitCallIn(wt, "diff", "--name-only", "--diff-filter=U")
+	gitCallIn(wt, "merge", "--abort")
+	if diffErr != nil {
+		return nil, true, diffErr
+	}
+	return splitLines(diffOut), true, nil
+}
+
+// splitLines splits git's newline-delimited output into a trimmed slice of
+// non-empty lines.
+func splitLines(s string) []string {
+	var out []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// Prune garbage-collects pr/N branches whose head commit's committer date is
+// older than maxAge, so a long-lived cache dir doesn't accumulate refs forever.
+func (s *splicer) Prune(maxAge time.Duration) error {
+	out, err := s.gitCallOut("for-each-ref", "--format=%(refname) %(committerdate:unix)", "refs/heads/pr")
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge).Unix()
+	for _, line := range splitLines(out) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if ts >= cutoff {
+			continue
+		}
+		branch := strings.TrimPrefix(fields[0], "refs/heads/")
+		if err := s.gitCall("branch", "-D", branch); err != nil {
+			log.WithError(err).Warnf("Error pruning stale ref %s", branch)
+		}
+	}
+	return nil
+}
+
+// gitRef returns the SHA for the given git object-- a branch, generally.
+func (s *splicer) gitRef(ref string) string {
+	output, err := call("git", "-C", s.dir, "rev-parse", ref)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(output)
+}
+
+// Produce a kube.Refs for the given pull requests. This involves computing the
+// git ref for master and the PRs.
+func (s *splicer) makeBuildRefs(org, repo string, prs []int) kube.Refs {
+	refs := kube.Refs{
+		Org:     org,
+		Repo:    repo,
+		BaseRef: "master",
+		BaseSHA: s.gitRef("master"),
+	}
+	for _, pr := range prs {
+		refs.Pulls = append(refs.Pulls, kube.Pull{Number: pr, SHA: s.gitRef(prBranch(pr))})
+	}
+	return refs
+}
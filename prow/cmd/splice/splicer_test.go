@@ -0,0 +1,183 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newFixtureRemote creates a throwaway git repo on disk with a base commit
+// and three PR refs (refs/pull/N/head, as GitHub exposes them) fetchable
+// exactly the way findMergeable fetches real PRs: PR 1 and PR 2 both edit
+// the same line differently (a real, verified merge conflict), and PR 3
+// edits an unrelated line (clean against everything).
+func newFixtureRemote(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "splice_fixture_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	run := func(args ...string) {
+		t.Helper()
+		full := append([]string{"-C", dir}, args...)
+		if out, err := call("git", full...); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, "f.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q")
+	run("config", "user.email", "splice-test@localhost")
+	run("config", "user.name", "splice-test")
+
+	base := make([]string, 12)
+	for i := range base {
+		base[i] = fmt.Sprintf("l%d", i+1)
+	}
+	write(strings.Join(base, "\n") + "\n")
+	run("add", "f.txt")
+	run("commit", "-q", "-m", "base")
+
+	mkPR := func(num, lineIdx int, newText string) {
+		branch := fmt.Sprintf("tmp-pr-%d", num)
+		run("checkout", "-q", "-b", branch, "master")
+		lines := append([]string{}, base...)
+		lines[lineIdx] = newText
+		write(strings.Join(lines, "\n") + "\n")
+		run("commit", "-q", "-a", "-m", fmt.Sprintf("pr%d", num))
+		run("checkout", "-q", "master")
+		run("update-ref", fmt.Sprintf("refs/pull/%d/head", num), branch)
+		run("branch", "-D", branch)
+	}
+	mkPR(1, 1, "l2-A")   // conflicts with PR 2
+	mkPR(2, 1, "l2-B")   // conflicts with PR 1
+	mkPR(3, 10, "l11-C") // independent of both
+
+	return dir
+}
+
+func TestFindMergeableAttribution(t *testing.T) {
+	remote := newFixtureRemote(t)
+
+	s, err := makeSplicer("", remote, "")
+	if err != nil {
+		t.Fatalf("makeSplicer: %v", err)
+	}
+	defer s.cleanup()
+
+	selected, conflicts, err := s.findMergeable(remote, []int{1, 2, 3}, 5, CountScorer{})
+	if err != nil {
+		t.Fatalf("findMergeable: %v", err)
+	}
+
+	sort.Ints(selected)
+	if !reflect.DeepEqual(selected, []int{1, 3}) {
+		t.Fatalf("findMergeable() selected = %v, want [1 3] (PR 2 conflicts with PR 1, so only one of them fits)", selected)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("findMergeable() conflicts = %v, want exactly one report", conflicts)
+	}
+	if c := conflicts[0]; c.PR != 2 || c.ConflictsWith != 1 {
+		t.Errorf("findMergeable() conflict = %+v, want PR 2 attributed to PR 1", c)
+	}
+	if c := conflicts[0]; len(c.Files) != 1 || c.Files[0] != "f.txt" {
+		t.Errorf("findMergeable() conflict files = %v, want [f.txt]", c.Files)
+	}
+}
+
+// TestVerifyBatchDropsConflictingPR exercises verifyBatch directly (bypassing
+// the optimizer) against a selected list that conflicts once merged
+// cumulatively, confirming it drops the later PR and attributes it to the
+// batch as a whole (ConflictsWith == 0), the exact contract findMergeable's
+// n-way safety net relies on.
+func TestVerifyBatchDropsConflictingPR(t *testing.T) {
+	remote := newFixtureRemote(t)
+
+	s, err := makeSplicer("", remote, "")
+	if err != nil {
+		t.Fatalf("makeSplicer: %v", err)
+	}
+	defer s.cleanup()
+
+	if err := s.gitCall("fetch", "-f", remote, "master:master",
+		"pull/1/head:"+prBranch(1), "pull/2/head:"+prBranch(2)); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	selected, conflicts, err := s.verifyBatch([]int{1, 2})
+	if err != nil {
+		t.Fatalf("verifyBatch: %v", err)
+	}
+	if !reflect.DeepEqual(selected, []int{1}) {
+		t.Errorf("verifyBatch() selected = %v, want [1]", selected)
+	}
+	if len(conflicts) != 1 || conflicts[0].PR != 2 || conflicts[0].ConflictsWith != 0 {
+		t.Errorf("verifyBatch() conflicts = %+v, want PR 2 attributed to the cumulative batch (ConflictsWith 0)", conflicts)
+	}
+}
+
+// TestAttributionPartners is a pure unit test of the bookkeeping findMergeable
+// uses to decide who gets blamed for an exclusion. It directly models the
+// double-attribution bug 1e76ef1 fixed: PR 2 was already attributed by
+// verifyBatch and must not pick up a second, contradictory attribution here,
+// even though it also pairwise-conflicts with PR 3.
+func TestAttributionPartners(t *testing.T) {
+	soloOK := []int{1, 2, 3, 4}
+	inBatch := map[int]bool{1: true}
+	attributed := map[int]bool{2: true}
+	conflictPairs := map[[2]int]bool{
+		{2, 3}: true,
+		{1, 4}: true,
+	}
+	conflictFn := func(a, b int) bool {
+		if a > b {
+			a, b = b, a
+		}
+		return conflictPairs[[2]int{a, b}]
+	}
+
+	got := attributionPartners(soloOK, inBatch, attributed, conflictFn)
+	want := map[int]int{3: 2, 4: 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attributionPartners() = %v, want %v (PR 2 must not appear: it's already attributed)", got, want)
+	}
+}
+
+func TestAttributionPartnersCapExcluded(t *testing.T) {
+	soloOK := []int{1, 2}
+	inBatch := map[int]bool{1: true}
+	conflictFn := func(a, b int) bool { return false }
+
+	got := attributionPartners(soloOK, inBatch, nil, conflictFn)
+	if len(got) != 0 {
+		t.Errorf("attributionPartners() = %v, want empty (PR 2 excluded only by the batch-size cap)", got)
+	}
+}
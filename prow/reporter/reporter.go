@@ -0,0 +1,142 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reporter posts the outcome of a batch ProwJob run back to the
+// GitHub PRs that made up the batch, closing the loop between batch
+// execution and PR authors.
+//
+// Only merge-conflict attribution (computed up front by the splicer, before
+// any job runs) is wired up here. Attributing a test *failure* to a single
+// PR by re-running the failing job on a single-PR subset is out of scope for
+// now -- Report has no way to tell which PR in a failed batch broke it.
+package reporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+
+	"k8s.io/test-infra/prow/kube"
+)
+
+// Conflict attributes a PR that could not be merged into, or failed within,
+// a batch to the specific PR it is in conflict with, if one was identified.
+type Conflict struct {
+	PR            int
+	ConflictsWith int
+	Files         []string
+}
+
+// BatchResult is the outcome of one round of batch ProwJobs, ready to be
+// reported back to the PRs that were included in the batch.
+type BatchResult struct {
+	Org, Repo string
+	Refs      kube.Refs
+	Jobs      []kube.ProwJob
+	Conflicts []Conflict
+}
+
+// Reporter posts GitHub commit statuses summarizing a batch run, plus a PR
+// comment for every PR a merge conflict was attributed to.
+type Reporter struct {
+	client  *github.Client
+	context string
+}
+
+// New creates a Reporter that authenticates with the token at tokenPath and
+// reports under the given commit status context.
+func New(tokenPath, reportContext string) (*Reporter, error) {
+	token, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading github token: %v", err)
+	}
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: strings.TrimSpace(string(token))})
+	hc := oauth2.NewClient(context.Background(), ts)
+	return &Reporter{
+		client:  github.NewClient(hc),
+		context: reportContext,
+	}, nil
+}
+
+// Report posts a commit status summarizing batch to the head SHA of every
+// PR that participated, and comments the conflict attribution onto every PR
+// a conflict was pinned on. The two PR sets are disjoint: batch.Refs.Pulls
+// is what actually made it into the tested batch, while batch.Conflicts
+// attributes PRs that were excluded from it before testing ever started, so
+// the comment is independent of batch.Jobs' outcome.
+func (r *Reporter) Report(ctx context.Context, batch BatchResult) error {
+	state, description, url := summarize(batch.Jobs)
+
+	var firstErr error
+	for _, pull := range batch.Refs.Pulls {
+		status := &github.RepoStatus{
+			State:       github.String(state),
+			TargetURL:   github.String(url),
+			Context:     github.String(r.context),
+			Description: github.String(description),
+		}
+		if _, _, err := r.client.Repositories.CreateStatus(ctx, batch.Org, batch.Repo, pull.SHA, status); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, conflict := range batch.Conflicts {
+		if err := r.commentConflict(ctx, batch.Org, batch.Repo, conflict); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// commentConflict leaves a comment on conflict.PR explaining which PR (or,
+// when ConflictsWith is 0, master or the batch state) it was attributed to
+// conflict with.
+func (r *Reporter) commentConflict(ctx context.Context, org, repo string, conflict Conflict) error {
+	var body string
+	if conflict.ConflictsWith == 0 {
+		body = fmt.Sprintf("This PR conflicts with master or with the rest of the batch it was considered for (files: %s).", strings.Join(conflict.Files, ", "))
+	} else {
+		body = fmt.Sprintf("This PR conflicts with #%d (files: %s).", conflict.ConflictsWith, strings.Join(conflict.Files, ", "))
+	}
+	comment := &github.IssueComment{Body: github.String(body)}
+	_, _, err := r.client.Issues.CreateComment(ctx, org, repo, conflict.PR, comment)
+	return err
+}
+
+// summarize reduces a set of completed batch ProwJobs to the overall
+// commit-status state, a human description, and a URL to link to.
+func summarize(jobs []kube.ProwJob) (state, description, url string) {
+	state = "success"
+	for _, job := range jobs {
+		if job.Status.URL != "" && url == "" {
+			url = job.Status.URL
+		}
+		if job.Status.State != kube.SuccessState {
+			state = "failure"
+			url = job.Status.URL
+		}
+	}
+	if state == "failure" {
+		description = "Batch tests failed."
+	} else {
+		description = "Batch tests passed."
+	}
+	return state, description, url
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/github"
+
+	"k8s.io/test-infra/prow/kube"
+)
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name            string
+		jobs            []kube.ProwJob
+		wantState       string
+		wantDescription string
+		wantURL         string
+	}{
+		{
+			name: "all passed",
+			jobs: []kube.ProwJob{
+				{Status: kube.ProwJobStatus{State: kube.SuccessState, URL: "http://first"}},
+				{Status: kube.ProwJobStatus{State: kube.SuccessState, URL: "http://second"}},
+			},
+			wantState:       "success",
+			wantDescription: "Batch tests passed.",
+			wantURL:         "http://first",
+		},
+		{
+			name: "one failure fails the batch and points at it",
+			jobs: []kube.ProwJob{
+				{Status: kube.ProwJobStatus{State: kube.SuccessState, URL: "http://first"}},
+				{Status: kube.ProwJobStatus{State: kube.FailureState, URL: "http://failed"}},
+			},
+			wantState:       "failure",
+			wantDescription: "Batch tests failed.",
+			wantURL:         "http://failed",
+		},
+		{
+			name:            "no jobs",
+			wantState:       "success",
+			wantDescription: "Batch tests passed.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, description, url := summarize(tt.jobs)
+			if state != tt.wantState {
+				t.Errorf("summarize() state = %q, want %q", state, tt.wantState)
+			}
+			if description != tt.wantDescription {
+				t.Errorf("summarize() description = %q, want %q", description, tt.wantDescription)
+			}
+			if url != tt.wantURL {
+				t.Errorf("summarize() url = %q, want %q", url, tt.wantURL)
+			}
+		})
+	}
+}
+
+// TestReportCommentsExcludedConflicts exercises Report end-to-end against a
+// stub GitHub server. PR 2 was excluded from the batch before testing ever
+// started (it's in batch.Conflicts but not batch.Refs.Pulls), so it must get
+// a conflict comment regardless of how the tested batch (PR 1 only) turned
+// out -- catching the class of bug where commenting was mistakenly gated on
+// matching batch.Refs.Pulls and/or a failed batch state.
+func TestReportCommentsExcludedConflicts(t *testing.T) {
+	var gotComment bool
+	var gotStatus bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/repo/statuses/sha1", func(w http.ResponseWriter, r *http.Request) {
+		gotStatus = true
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/repos/org/repo/issues/2/comments", func(w http.ResponseWriter, r *http.Request) {
+		gotComment = true
+		w.Write([]byte(`{}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(ts.URL + "/")
+	r := &Reporter{client: client, context: "prow/batch"}
+
+	batch := BatchResult{
+		Org:  "org",
+		Repo: "repo",
+		Refs: kube.Refs{Pulls: []kube.Pull{{Number: 1, SHA: "sha1"}}},
+		Jobs: []kube.ProwJob{{Status: kube.ProwJobStatus{State: kube.SuccessState, URL: "http://first"}}},
+		Conflicts: []Conflict{
+			{PR: 2, ConflictsWith: 0, Files: []string{"a.go"}},
+		},
+	}
+
+	if err := r.Report(context.Background(), batch); err != nil {
+		t.Fatalf("Report() = %v, want nil", err)
+	}
+	if !gotStatus {
+		t.Error("Report() never posted a commit status for PR 1")
+	}
+	if !gotComment {
+		t.Error("Report() never commented on PR 2, the excluded conflicting PR")
+	}
+}